@@ -0,0 +1,126 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// ErrResourceExhausted is returned (wrapped) when an invocation is refused or
+// terminated for exceeding a configured resource limit, as opposed to hitting
+// ExecTimeout: from Module.NewInstance for MaxMemoryPages, from
+// Instance.Start for Fuel, and from WasmFunctionRunner.Run for MaxOpenFiles.
+// Callers such as the HTTP layer can use errors.Is to respond 429/503
+// instead of 500.
+var ErrResourceExhausted = errors.New("wasm instance exceeded a configured resource limit")
+
+// runtimeEnvVar selects the wasm execution backend at start-up, e.g.
+// WATCHDOG_WASM_RUNTIME=wazero. Unset falls back to defaultRuntimeName; an
+// unrecognised or not-built-in name makes newRuntime return an error.
+const runtimeEnvVar = "WATCHDOG_WASM_RUNTIME"
+
+// defaultRuntimeName is used when runtimeEnvVar is unset. wazero is pure Go
+// and always compiled in, so it is the safe default for builds that drop the
+// cgo/wasmer dependency.
+const defaultRuntimeName = "wazero"
+
+// Runtime abstracts a WebAssembly execution engine so WasmFunctionRunner does
+// not depend on any single backend. wasmer-gpu-go and wazero both implement
+// this by registering themselves via registerRuntime in an init func; the
+// wasmer backend is guarded by the "wasmer" build tag, while wazero has no
+// build tag and is always compiled in.
+type Runtime interface {
+	// Compile parses and validates wasm bytecode, producing a re-usable Module.
+	Compile(wasmBytes []byte) (Module, error)
+	// Close releases any resources held by the runtime itself.
+	Close() error
+}
+
+// Module is a compiled, instantiable wasm program.
+type Module interface {
+	// NewInstance instantiates the module with the given WASI configuration.
+	NewInstance(cfg WASIConfig) (Instance, error)
+	Close() error
+}
+
+// multiPreopener is implemented by Modules whose backend can preopen more
+// than one guest directory for a single instance. WasmFunctionRunner.Run
+// uses it to decide between mounting a read-only data dir directly under
+// /data and falling back to the older per-file symlink strategy.
+type multiPreopener interface {
+	SupportsMultiPreopen() bool
+}
+
+// Instance is a single running (or ready to run) instantiation of a Module.
+type Instance interface {
+	// Start invokes the WASI `_start` entrypoint and blocks until it returns.
+	Start() error
+	// Close forcibly terminates the instance, unblocking any in-flight Start call.
+	Close() error
+}
+
+// WASIConfig carries the per-invocation WASI environment: args, env vars,
+// directory preopens and standard stream plumbing.
+type WASIConfig struct {
+	Args []string
+	Env  map[string]string
+
+	// Preopens maps guest path -> host path, e.g. {"/": wasmWorkDir}, mounted
+	// read-write.
+	Preopens map[string]string
+
+	// ReadOnlyPreopens is Preopens, but mounted so the guest can't write to
+	// them; used for e.g. a shared data dir that invocations must not
+	// mutate. Backends that can't enforce read-only mounts return an error
+	// from NewInstance when this is set.
+	ReadOnlyPreopens map[string]string
+
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+
+	// Listener, if set, is preopened as a WASI socket for the guest instead
+	// of (or in addition to) the usual stdio/directory preopens, letting a
+	// long-running guest accept connections itself. Experimental: backends
+	// that can't preopen sockets (e.g. wasmer) return an error from
+	// NewInstance when this is set.
+	Listener net.Listener
+
+	// MaxMemoryPages caps the guest's linear memory, 0 means backend
+	// default. Instantiation fails if the guest declares a larger memory
+	// max than this, or (backend permitting) no bounded max at all, since
+	// there's otherwise nothing to enforce the cap against. Backends that
+	// can't enforce it (e.g. wasmer) return an error from NewInstance
+	// whenever this is set.
+	MaxMemoryPages uint32
+
+	// Fuel is a coarse execution budget for the instance; reaching zero
+	// terminates it the same way ExecTimeout does. 0 disables the limit.
+	// Backends that can't meter execution (e.g. wasmer) return an error
+	// from NewInstance when this is set, rather than silently ignoring it.
+	Fuel uint64
+}
+
+// runtimeFactories holds the backends compiled into this binary. Populated by
+// init() in each backend's file; only the wasmer file is gated by a build tag.
+var runtimeFactories = map[string]func() (Runtime, error){}
+
+// registerRuntime makes a backend available under name for runtimeEnvVar.
+func registerRuntime(name string, factory func() (Runtime, error)) {
+	runtimeFactories[name] = factory
+}
+
+// newRuntime builds the Runtime selected by runtimeEnvVar, or the default.
+func newRuntime() (Runtime, error) {
+	name := os.Getenv(runtimeEnvVar)
+	if name == "" {
+		name = defaultRuntimeName
+	}
+
+	factory, ok := runtimeFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown or not-built-in wasm runtime %q (set %s to one of the built backends)", name, runtimeEnvVar)
+	}
+	return factory()
+}
@@ -0,0 +1,135 @@
+//go:build wasmer
+
+package executor
+
+import (
+	"fmt"
+
+	"github.com/yanghaku/wasmer-gpu-go/wasmer"
+)
+
+func init() {
+	registerRuntime("wasmer", newWasmerRuntime)
+}
+
+// wasmerRuntime adapts github.com/yanghaku/wasmer-gpu-go/wasmer to the
+// Runtime interface. It is only compiled in with the "wasmer" build tag,
+// since wasmer-gpu-go pulls in cgo and a CUDA-capable libwasmer.
+type wasmerRuntime struct {
+	store *wasmer.Store
+}
+
+func newWasmerRuntime() (Runtime, error) {
+	return &wasmerRuntime{store: wasmer.NewStore(wasmer.NewEngine())}, nil
+}
+
+func (r *wasmerRuntime) Compile(wasmBytes []byte) (Module, error) {
+	mod, err := wasmer.NewModule(r.store, wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &wasmerModule{store: r.store, module: mod}, nil
+}
+
+func (r *wasmerRuntime) Close() error {
+	return nil
+}
+
+type wasmerModule struct {
+	store  *wasmer.Store
+	module *wasmer.Module
+}
+
+func (m *wasmerModule) NewInstance(cfg WASIConfig) (Instance, error) {
+	if cfg.Listener != nil {
+		return nil, fmt.Errorf("wasmer: preopened sockets (Server mode) are not supported by this backend")
+	}
+	if len(cfg.ReadOnlyPreopens) > 0 {
+		return nil, fmt.Errorf("wasmer: read-only directory preopens are not supported by this backend")
+	}
+	if cfg.Fuel != 0 {
+		return nil, fmt.Errorf("wasmer: Fuel metering is not implemented by this backend yet")
+	}
+	if cfg.MaxMemoryPages != 0 {
+		return nil, fmt.Errorf("wasmer: MaxMemoryPages is not implemented by this backend yet")
+	}
+
+	name := "wasm"
+	if len(cfg.Args) > 0 {
+		name = cfg.Args[0]
+	}
+
+	builder := wasmer.NewWasiStateBuilder(name).CaptureStdout().CaptureStderr()
+	for _, arg := range cfg.Args[1:] {
+		builder.Argument(arg)
+	}
+	for k, v := range cfg.Env {
+		builder.Environment(k, v)
+	}
+	for guest, host := range cfg.Preopens {
+		builder.MapDirectory(guest, host)
+	}
+
+	wasiEnv, err := builder.Finalize()
+	if err != nil {
+		return nil, err
+	}
+
+	importObject, err := wasiEnv.GenerateImportObject(m.store, m.module)
+	if err != nil {
+		return nil, err
+	}
+
+	cudaEnv := wasmer.NewCudaEnvironment()
+	if err := cudaEnv.AddImportObject(m.store, importObject); err != nil {
+		return nil, err
+	}
+
+	instance, err := wasmer.NewInstance(m.module, importObject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wasmerInstance{instance: instance, wasiEnv: wasiEnv, cfg: cfg}, nil
+}
+
+func (m *wasmerModule) Close() error {
+	return nil
+}
+
+// wasmerInstance buffers stdout/stderr via wasmer's Capture* API and copies
+// it into cfg.Stdout/Stderr once Start returns, since wasmer-gpu-go has no
+// streaming stdio hooks. cfg.Stdin is not passed to the guest: instances of
+// this backend get no stdin.
+type wasmerInstance struct {
+	instance *wasmer.Instance
+	wasiEnv  *wasmer.WasiEnvironment
+	cfg      WASIConfig
+}
+
+func (i *wasmerInstance) Start() error {
+	start, err := i.instance.Exports.GetWasiStartFunction()
+	if err != nil {
+		return err
+	}
+
+	_, err = start()
+
+	if i.cfg.Stdout != nil {
+		if _, werr := i.cfg.Stdout.Write(i.wasiEnv.ReadStdout()); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	if i.cfg.Stderr != nil {
+		if _, werr := i.cfg.Stderr.Write(i.wasiEnv.ReadStderr()); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	return err
+}
+
+func (i *wasmerInstance) Close() error {
+	i.instance.Close()
+	return nil
+}
@@ -0,0 +1,238 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/sock"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func init() {
+	registerRuntime("wazero", newWazeroRuntime)
+}
+
+// wazeroRuntime adapts github.com/tetratelabs/wazero to the Runtime
+// interface. It is pure Go (no cgo), so it is always compiled in and is the
+// default backend.
+type wazeroRuntime struct {
+	ctx context.Context
+	rt  wazero.Runtime
+}
+
+// compilationCache is shared across every wazeroRuntime in the process so
+// repeated warm starts (e.g. after a scale-up) skip re-compiling wasm that
+// was already seen.
+var compilationCache = wazero.NewCompilationCache()
+
+func newWazeroRuntime() (Runtime, error) {
+	ctx := context.Background()
+	cfg := wazero.NewRuntimeConfig().
+		WithCompilationCache(compilationCache).
+		WithCloseOnContextDone(true)
+	rt := wazero.NewRuntimeWithConfig(ctx, cfg)
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		return nil, err
+	}
+
+	return &wazeroRuntime{ctx: ctx, rt: rt}, nil
+}
+
+func (r *wazeroRuntime) Compile(wasmBytes []byte) (Module, error) {
+	compiled, err := r.rt.CompileModule(r.ctx, wasmBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &wazeroModule{ctx: r.ctx, rt: r.rt, compiled: compiled}, nil
+}
+
+func (r *wazeroRuntime) Close() error {
+	return r.rt.Close(r.ctx)
+}
+
+type wazeroModule struct {
+	ctx      context.Context
+	rt       wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+func (m *wazeroModule) NewInstance(cfg WASIConfig) (Instance, error) {
+	if cfg.MaxMemoryPages > 0 {
+		// wazero enforces memory growth limits at RuntimeConfig level,
+		// shared across every instance the Runtime ever creates, not as a
+		// per-instantiation option, so there's nothing to pass a per-request
+		// cap into here. The best this per-instance check can do is fail
+		// closed: require the guest to declare its own bounded max at or
+		// under the cap, rather than silently letting an unbounded-growth
+		// guest past the limit.
+		memDef := moduleMemory(m.compiled)
+		if memDef == nil {
+			return nil, fmt.Errorf("%w: MaxMemoryPages is set but the guest neither exports nor imports a memory", ErrResourceExhausted)
+		}
+		max, hasMax := memDef.Max()
+		if !hasMax {
+			return nil, fmt.Errorf("%w: MaxMemoryPages requires the guest to declare a bounded memory max, got none", ErrResourceExhausted)
+		}
+		if max > cfg.MaxMemoryPages {
+			return nil, fmt.Errorf("%w: guest declares memory max of %d pages, limit is %d", ErrResourceExhausted, max, cfg.MaxMemoryPages)
+		}
+	}
+
+	// Disable wazero's default auto-invocation of _start so Instance.Start
+	// can drive (and the timeout/fuel logic in runFunc can cancel) it
+	// explicitly, the same way the wasmer backend does.
+	modCfg := wazero.NewModuleConfig().WithStartFunctions().WithArgs(cfg.Args...)
+
+	for k, v := range cfg.Env {
+		modCfg = modCfg.WithEnv(k, v)
+	}
+	if cfg.Stdin != nil {
+		modCfg = modCfg.WithStdin(cfg.Stdin)
+	}
+	if cfg.Stdout != nil {
+		modCfg = modCfg.WithStdout(cfg.Stdout)
+	}
+	if cfg.Stderr != nil {
+		modCfg = modCfg.WithStderr(cfg.Stderr)
+	}
+
+	fsCfg := wazero.NewFSConfig()
+	for guest, host := range cfg.Preopens {
+		fsCfg = fsCfg.WithDirMount(host, guest)
+	}
+	for guest, host := range cfg.ReadOnlyPreopens {
+		fsCfg = fsCfg.WithReadOnlyDirMount(host, guest)
+	}
+	modCfg = modCfg.WithFSConfig(fsCfg)
+
+	ctx, cancel := context.WithCancel(m.ctx)
+
+	// wazero's interpreter has no native instruction-metering knob like
+	// wasmtime's fuel, so Fuel is approximated by counting guest function
+	// calls through a FunctionListener and cancelling ctx (same mechanism
+	// ExecTimeout uses) once the budget hits zero.
+	var fuel *uint64
+	if cfg.Fuel > 0 {
+		budget := cfg.Fuel
+		fuel = &budget
+		ctx = experimental.WithFunctionListenerFactory(ctx, &fuelListenerFactory{remaining: fuel, cancel: cancel})
+	}
+
+	if cfg.Listener != nil {
+		tcpListener, ok := cfg.Listener.(*net.TCPListener)
+		if !ok {
+			cancel()
+			return nil, fmt.Errorf("wazero: preopened sockets require a *net.TCPListener, got %T", cfg.Listener)
+		}
+		addr, ok := tcpListener.Addr().(*net.TCPAddr)
+		if !ok {
+			cancel()
+			return nil, fmt.Errorf("wazero: preopened sockets require a TCP address, got %T", tcpListener.Addr())
+		}
+		// sock.Config.WithTCPListener takes a host:port to bind itself,
+		// rather than adopting an already-listening *net.TCPListener, so
+		// give up the listener callers used to resolve cfg.Listener's
+		// address (e.g. to learn the port chosen for ":0") and let wazero
+		// rebind the same host:port for the guest.
+		if err := tcpListener.Close(); err != nil {
+			cancel()
+			return nil, err
+		}
+		host := addr.IP.String()
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			host = ""
+		}
+		ctx = sock.WithConfig(ctx, sock.NewConfig().WithTCPListener(host, addr.Port))
+	}
+
+	mod, err := m.rt.InstantiateModule(ctx, m.compiled, modCfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &wazeroInstance{ctx: ctx, cancel: cancel, mod: mod, fuel: fuel}, nil
+}
+
+func (m *wazeroModule) Close() error {
+	return m.compiled.Close(m.ctx)
+}
+
+// moduleMemory returns the guest's single memory, exported or imported, or
+// nil if it neither exports nor imports one; a memory the guest defines but
+// does not export is not seen, so it also yields nil. The wasm MVP allows at most one memory per
+// module, so unlike ExportedMemories (keyed by export name, since a module
+// can export the same memory under several names) there's no ambiguity in
+// picking "the" memory to check MaxMemoryPages against.
+func moduleMemory(compiled wazero.CompiledModule) api.MemoryDefinition {
+	for _, def := range compiled.ExportedMemories() {
+		return def
+	}
+	if imported := compiled.ImportedMemories(); len(imported) > 0 {
+		return imported[0]
+	}
+	return nil
+}
+
+// SupportsMultiPreopen reports that wazero can map any number of guest paths
+// via WithDirMount, so WasmFunctionRunner can mount a data dir under /data
+// alongside the per-instance work dir instead of symlinking its contents.
+func (m *wazeroModule) SupportsMultiPreopen() bool {
+	return true
+}
+
+// fuelListenerFactory decrements remaining on every guest function call and
+// cancels the instance once it reaches zero; see the Fuel comment above.
+type fuelListenerFactory struct {
+	remaining *uint64
+	cancel    context.CancelFunc
+}
+
+func (f *fuelListenerFactory) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return f
+}
+
+func (f *fuelListenerFactory) Before(_ context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	if atomic.LoadUint64(f.remaining) == 0 {
+		return
+	}
+	if atomic.AddUint64(f.remaining, ^uint64(0)) == 0 {
+		f.cancel()
+	}
+}
+
+func (f *fuelListenerFactory) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (f *fuelListenerFactory) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
+
+type wazeroInstance struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	mod    api.Module
+
+	// fuel is non-nil when cfg.Fuel > 0; Start checks it to tell a
+	// fuel-exhaustion cancellation apart from any other instance error.
+	fuel *uint64
+}
+
+func (i *wazeroInstance) Start() error {
+	start := i.mod.ExportedFunction("_start")
+	_, err := start.Call(i.ctx)
+	if err != nil && i.fuel != nil && atomic.LoadUint64(i.fuel) == 0 {
+		return fmt.Errorf("%w: exceeded fuel budget", ErrResourceExhausted)
+	}
+	return err
+}
+
+func (i *wazeroInstance) Close() error {
+	// Cancel first: with WithCloseOnContextDone, this unblocks any in-flight
+	// Start() call promptly instead of waiting on the module close alone.
+	i.cancel()
+	return i.mod.Close(i.ctx)
+}
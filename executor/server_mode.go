@@ -0,0 +1,138 @@
+package executor
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// serverWorkDir is the preopen root for the Server-mode instance. It is
+// deliberately its own directory rather than a OneShot funcId slot: those
+// slots come and go from freeFuncId while Run callers run concurrently, so
+// reusing one (e.g. "0") could hand the server a dir a concurrent Run is
+// also cleaning up, or leave it booting against whatever that id's last
+// OneShot invocation left behind.
+const serverWorkDir = "server"
+
+// Mode selects how a WasmFunctionRunner treats its compiled Module.
+type Mode int
+
+const (
+	// OneShot invokes the guest's _start entrypoint once per FunctionRequest,
+	// the classic of-watchdog process-per-request model.
+	OneShot Mode = iota
+
+	// Server preopens a TCP listener and hands it to the guest as a WASI
+	// socket, treating the single instance as a long-lived process that
+	// serves HTTP itself; FunctionRequests are then reverse-proxied to the
+	// guest's listener instead of invoking _start per request. Experimental:
+	// only backends that can preopen sockets (currently wazero) support it.
+	Server
+)
+
+// ServerConfig configures Mode == Server.
+type ServerConfig struct {
+	// ListenAddr is the host address the watchdog binds and preopens into
+	// the guest, e.g. ":8080". Callers reverse-proxy FunctionRequests here.
+	ListenAddr string
+}
+
+// serverInstance tracks the single long-lived instance started by StartServer.
+type serverInstance struct {
+	instance Instance
+	listener net.Listener
+	done     chan error
+}
+
+// StartServer binds f.ServerConfig.ListenAddr, preopens it as a WASI socket
+// for the guest, and starts the instance running in the background. It is
+// only valid when f.Mode == Server, and replaces Run for the lifetime of the
+// server: callers should reverse-proxy FunctionRequests to
+// f.ServerConfig.ListenAddr rather than calling Run.
+func (f *WasmFunctionRunner) StartServer() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.Mode != Server {
+		return fmt.Errorf("StartServer requires Mode == Server")
+	}
+	if f.server != nil {
+		return fmt.Errorf("server already running, call StopServer first")
+	}
+
+	// clean slate for the preopen dir, same as Run does for its work dir
+	exists, _, err := statDir(serverWorkDir)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := os.RemoveAll(serverWorkDir); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(serverWorkDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", f.ServerConfig.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	cfg := WASIConfig{
+		Args:     append([]string{f.Process}, f.ProcessArgs...),
+		Env:      map[string]string{"PWD": "/"},
+		Preopens: map[string]string{"/": serverWorkDir},
+		Listener: listener,
+	}
+
+	instance, err := f.Module.NewInstance(cfg)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- instance.Start()
+	}()
+
+	f.server = &serverInstance{instance: instance, listener: listener, done: done}
+	return nil
+}
+
+// StopServer gracefully shuts down the running server instance, unblocking
+// its Start call and closing the listener. It is safe to call even if no
+// server is running, and is used ahead of a restart (e.g. module reload or
+// scale-to-zero) to get a clean slate for the next StartServer.
+func (f *WasmFunctionRunner) StopServer() error {
+	f.mutex.Lock()
+	srv := f.server
+	f.server = nil
+	f.mutex.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+
+	closeErr := srv.instance.Close()
+	<-srv.done
+	srv.listener.Close()
+
+	// clean this work dir so a following StartServer (restart, scale-to-zero
+	// and back) boots against a fresh dir rather than this run's leftovers
+	if err := os.RemoveAll(serverWorkDir); err != nil && closeErr == nil {
+		closeErr = err
+	}
+
+	return closeErr
+}
+
+// RestartServer is StopServer followed by StartServer, used to pick up a
+// recompiled Module or a config change without leaking the old listener.
+func (f *WasmFunctionRunner) RestartServer() error {
+	if err := f.StopServer(); err != nil {
+		return err
+	}
+	return f.StartServer()
+}
@@ -0,0 +1,24 @@
+package executor
+
+import "io"
+
+// FunctionRequest is a single invocation of the wasm function: where to read
+// stdin and write stdout, and the HTTP context that should be forwarded into
+// the guest's WASI environment, matching OpenFaaS's classic watchdog
+// contract (Http_Method, Http_Path, ...).
+type FunctionRequest struct {
+	InputReader  io.ReadCloser
+	OutputWriter io.Writer
+
+	Method        string
+	Path          string
+	Query         string
+	ContentLength int64
+
+	// Header holds the incoming HTTP headers, forwarded as Http_<HEADER>.
+	Header map[string][]string
+
+	// EnvVars are additional environment variables for the guest, filtered
+	// through WasmFunctionRunner.EnvAllowlist before being set.
+	EnvVars map[string]string
+}
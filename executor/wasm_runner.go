@@ -1,11 +1,13 @@
 package executor
 
 import (
+	"bytes"
 	"fmt"
-	"github.com/yanghaku/wasmer-gpu-go/wasmer"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,17 +30,55 @@ type WasmFunctionRunner struct {
 	ExecTimeout time.Duration
 	LogPrefix   bool
 
+	// StreamIO pipes stdin/stdout straight through to the guest instead of
+	// buffering the whole request/response in memory. Runtimes that cannot
+	// pipe (e.g. the wasmer backend) silently fall back to buffered mode.
+	StreamIO bool
+
+	// EnvAllowlist restricts which names from FunctionRequest.EnvVars are
+	// forwarded into the guest. A nil/empty allowlist forwards none, so
+	// functions must opt in rather than silently inheriting everything
+	// callers put on the request.
+	EnvAllowlist []string
+
+	// Mode selects between the classic OneShot (one guest invocation per
+	// Run) and the experimental Server model. Defaults to OneShot.
+	Mode Mode
+	// ServerConfig is only used when Mode == Server.
+	ServerConfig ServerConfig
+
+	// MaxMemoryPages caps the guest's linear memory; see
+	// WASIConfig.MaxMemoryPages. 0 leaves the backend default in place.
+	MaxMemoryPages uint32
+	// Fuel caps guest execution; see WASIConfig.Fuel. 0 disables the limit.
+	Fuel uint64
+	// MaxOpenFiles caps how many entries under DataAbsPath may be fanned out
+	// as symlinks into a single invocation's work dir. 0 disables the
+	// check. Run fails with ErrResourceExhausted rather than silently
+	// symlinking tens of thousands of files.
+	MaxOpenFiles int
+
 	Process     string
 	ProcessArgs []string
 	DataAbsPath *string
 
-	WasmRoot   string
-	WasmModule *wasmer.Module
-	WasmStore  *wasmer.Store
+	WasmRoot string
+	Runtime  Runtime
+	Module   Module
 
 	freeFuncId chan int
 	replicas   int
 	mutex      sync.Mutex
+
+	// scaleMu serializes the drain phase of a shrink, which can block for up
+	// to deadline and so must not hold mutex. retiring is (re)computed from
+	// f.replicas only after scaleMu is held (see ScaleFunc), so a second
+	// concurrent shrink waits behind the first instead of racing it with a
+	// stale retiring set built from a f.replicas snapshot the first call has
+	// already acted on.
+	scaleMu sync.Mutex
+
+	server *serverInstance
 }
 
 // NewWasmFunctionRunner make a new WasmFunctionRunner and init for warm start
@@ -59,14 +99,20 @@ func NewWasmFunctionRunner(execTimeout time.Duration, prefixLogs bool,
 		return nil, err
 	}
 
-	store := wasmer.NewStore(wasmer.NewEngine())
-	module, err := wasmer.NewModule(store, wasmBytes)
+	runtime, err := newRuntime()
+	if err != nil {
+		return nil, err
+	}
+
+	// compile once here so every Run call reuses the same Module, mirroring
+	// wazero's CompilationCache for warm start
+	module, err := runtime.Compile(wasmBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	runner.WasmStore = store
-	runner.WasmModule = module
+	runner.Runtime = runtime
+	runner.Module = module
 
 	// check work directory
 	runAbsPath := wasmRoot + runDir + commandName
@@ -113,6 +159,10 @@ func NewWasmFunctionRunner(execTimeout time.Duration, prefixLogs bool,
 }
 
 func (f *WasmFunctionRunner) Run(req FunctionRequest) error {
+	if f.Mode == Server {
+		return fmt.Errorf("Run is a OneShot operation; in Server mode reverse-proxy requests to f.ServerConfig.ListenAddr instead")
+	}
+
 	funcId := <-f.freeFuncId
 	defer func() {
 		f.freeFuncId <- funcId
@@ -135,21 +185,34 @@ func (f *WasmFunctionRunner) Run(req FunctionRequest) error {
 	if err := os.MkdirAll(wasmWorkDir, os.ModePerm); err != nil {
 		return err
 	}
-	// create the link for all data file to run directory
+	// dataOverlay, when set, is mounted directly as a second preopen at
+	// /data in runFunc instead of symlinking every file from DataAbsPath
+	// into wasmWorkDir, which is both O(files) syscalls and unable to
+	// expose subdirectories. Only used when the backend supports it (see
+	// multiPreopener); otherwise fall back to the old symlink fan-out.
+	var dataOverlay string
 	if f.DataAbsPath != nil {
-		fileInfos, err := ioutil.ReadDir(*f.DataAbsPath)
-		if err != nil {
-			return err
-		}
-		for _, fi := range fileInfos {
-			if err := os.Symlink(*f.DataAbsPath+fi.Name(), wasmWorkDir+"/"+fi.Name()); err != nil {
+		if f.supportsMultiPreopen() {
+			dataOverlay = *f.DataAbsPath
+		} else {
+			fileInfos, err := ioutil.ReadDir(*f.DataAbsPath)
+			if err != nil {
 				return err
 			}
+			if f.MaxOpenFiles > 0 && len(fileInfos) > f.MaxOpenFiles {
+				return fmt.Errorf("%w: data dir %s has %d files, exceeds MaxOpenFiles(%d)",
+					ErrResourceExhausted, *f.DataAbsPath, len(fileInfos), f.MaxOpenFiles)
+			}
+			for _, fi := range fileInfos {
+				if err := os.Symlink(*f.DataAbsPath+fi.Name(), wasmWorkDir+"/"+fi.Name()); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
 	// running function
-	err = f.runFunc(req, wasmWorkDir)
+	err = f.runFunc(req, wasmWorkDir, dataOverlay)
 
 	// clean this work dir
 	if err := os.RemoveAll(wasmWorkDir); err != nil {
@@ -159,8 +222,17 @@ func (f *WasmFunctionRunner) Run(req FunctionRequest) error {
 	return err
 }
 
-// runFunc instance a func and run it
-func (f *WasmFunctionRunner) runFunc(req FunctionRequest, funcId string) error {
+// supportsMultiPreopen reports whether f.Module can mount more than one
+// guest directory for a single instance; see multiPreopener.
+func (f *WasmFunctionRunner) supportsMultiPreopen() bool {
+	mp, ok := f.Module.(multiPreopener)
+	return ok && mp.SupportsMultiPreopen()
+}
+
+// runFunc instance a func and run it. dataOverlay, if non-empty, is the host
+// path to mount read-only at /data (see dataOverlay in Run); the guest then
+// finds its data files at /data/<name> instead of /<name>.
+func (f *WasmFunctionRunner) runFunc(req FunctionRequest, funcId, dataOverlay string) error {
 	log.Printf("process name =  %s", f.Process)
 	log.Printf("process args = %s", f.ProcessArgs)
 	log.Printf("running function Id = %s", funcId)
@@ -168,51 +240,34 @@ func (f *WasmFunctionRunner) runFunc(req FunctionRequest, funcId string) error {
 
 	startTime := time.Now()
 
-	wasiEnvBuilder := wasmer.NewWasiStateBuilder(f.Process).CaptureStdout().CaptureStderr()
-	for _, arg := range f.ProcessArgs {
-		wasiEnvBuilder.Argument(arg)
-	}
-	// map the root directory
-	wasiEnvBuilder.MapDirectory("/", funcId)
-	wasiEnvBuilder.Environment("PWD", "/")
-	// todo: resolve the environment variable
+	stdin, stdout, waitStdout, closeIO := f.buildStdio(req)
+	defer closeIO()
 
-	wasiEnv, err := wasiEnvBuilder.Finalize()
-	if err != nil {
-		log.Println(err)
-		return err
+	preopens := map[string]string{"/": funcId}
+	var readOnlyPreopens map[string]string
+	if dataOverlay != "" {
+		readOnlyPreopens = map[string]string{"/data": dataOverlay}
 	}
 
-	importObject, err := wasiEnv.GenerateImportObject(f.WasmStore, f.WasmModule)
-	if err != nil {
-		log.Println(err)
-		return err
+	var stderr bytes.Buffer
+	cfg := WASIConfig{
+		Args:             append([]string{f.Process}, f.ProcessArgs...),
+		Env:              f.buildEnv(req),
+		Preopens:         preopens,
+		ReadOnlyPreopens: readOnlyPreopens,
+		Stdin:            stdin,
+		Stdout:           stdout,
+		Stderr:           &stderr,
+		MaxMemoryPages:   f.MaxMemoryPages,
+		Fuel:             f.Fuel,
 	}
 
-	cudaEnv := wasmer.NewCudaEnvironment()
-	err = cudaEnv.AddImportObject(f.WasmStore, importObject)
+	instance, err := f.Module.NewInstance(cfg)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	instance, err := wasmer.NewInstance(f.WasmModule, importObject)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	start, err := instance.Exports.GetWasiStartFunction()
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	if req.InputReader != nil {
-		// todo: read the stdin
-		defer req.InputReader.Close()
-	}
-
 	// execute time out
 	var timer *time.Timer
 	if f.ExecTimeout > 0 {
@@ -230,27 +285,114 @@ func (f *WasmFunctionRunner) runFunc(req FunctionRequest, funcId string) error {
 		defer timer.Stop()
 	}
 
-	_, err = start()
-	if err != nil {
-		// try capture the stderr
-		go wasmLogging(f.Process+":"+funcId, wasiEnv.ReadStderr(), f.LogPrefix)
-		return err
+	startErr := instance.Start()
+
+	// closeIO/waitStdout need the guest's stdout writer closed before they
+	// can observe EOF, regardless of whether Start succeeded or was cut
+	// short by ExecTimeout above.
+	if err := waitStdout(); err != nil && startErr == nil {
+		startErr = err
 	}
 
-	_, err = req.OutputWriter.Write(wasiEnv.ReadStdout())
-	if err != nil {
-		return err
+	if startErr != nil {
+		// try capture the stderr
+		go wasmLogging(f.Process+":"+funcId, stderr.Bytes(), f.LogPrefix)
+		return startErr
 	}
 
 	duringTime := time.Since(startTime)
 	log.Printf("Took %v us ( %v ms )", duringTime.Microseconds(), duringTime.Milliseconds())
 
 	// capture the stderr for function
-	go wasmLogging(f.Process+":"+funcId, wasiEnv.ReadStderr(), f.LogPrefix)
+	go wasmLogging(f.Process+":"+funcId, stderr.Bytes(), f.LogPrefix)
 
 	return nil
 }
 
+// buildEnv assembles the guest WASI environment for req: PWD, the
+// of-watchdog HTTP-mode variables (Http_Method, Http_Path, Http_Query,
+// Http_ContentLength, Http_<HEADER> per incoming header), and any
+// caller-supplied EnvVars that appear in f.EnvAllowlist.
+func (f *WasmFunctionRunner) buildEnv(req FunctionRequest) map[string]string {
+	env := map[string]string{
+		"PWD":                "/",
+		"Http_Method":        req.Method,
+		"Http_Path":          req.Path,
+		"Http_Query":         req.Query,
+		"Http_ContentLength": strconv.FormatInt(req.ContentLength, 10),
+	}
+
+	for name, values := range req.Header {
+		if len(values) == 0 {
+			continue
+		}
+		key := "Http_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		env[key] = values[0]
+	}
+
+	for _, name := range f.EnvAllowlist {
+		if v, ok := req.EnvVars[name]; ok {
+			env[name] = v
+		}
+	}
+
+	return env
+}
+
+// buildStdio wires up req.InputReader/req.OutputWriter for the instance.
+// Without StreamIO, req.InputReader is handed to the instance as stdin
+// directly and stdout is buffered and flushed to req.OutputWriter once the
+// guest returns. In StreamIO mode req.InputReader is copied into the guest's
+// stdin through a pipe by a background goroutine, and stdout is also piped
+// so large payloads don't have to be fully buffered and streaming responses
+// become possible. Runtimes without pipe support (e.g. wasmer) still write
+// stdout only once the guest returns, whichever mode is used.
+// waitStdout must be called after instance.Start returns (success or not) to
+// observe any copy error and unblock the copying goroutine; closeIO is safe
+// to defer unconditionally and cleans up req.InputReader plus any open pipes.
+func (f *WasmFunctionRunner) buildStdio(req FunctionRequest) (stdin io.Reader, stdout io.Writer, waitStdout func() error, closeIO func()) {
+	var closers []io.Closer
+	closeIO = func() {
+		if req.InputReader != nil {
+			req.InputReader.Close()
+		}
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	if !f.StreamIO {
+		buf := &bytes.Buffer{}
+		return req.InputReader, buf, func() error {
+			_, err := req.OutputWriter.Write(buf.Bytes())
+			return err
+		}, closeIO
+	}
+
+	if req.InputReader != nil {
+		stdinR, stdinW := io.Pipe()
+		go func() {
+			_, _ = io.Copy(stdinW, req.InputReader)
+			stdinW.Close()
+		}()
+		stdin = stdinR
+		closers = append(closers, stdinR)
+	}
+
+	stdoutR, stdoutW := io.Pipe()
+	closers = append(closers, stdoutR)
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(req.OutputWriter, stdoutR)
+		copyDone <- err
+	}()
+
+	return stdin, stdoutW, func() error {
+		stdoutW.Close()
+		return <-copyDone
+	}, closeIO
+}
+
 // ReadScale return the replicas of functions
 func (f *WasmFunctionRunner) ReadScale() int {
 	f.mutex.Lock()
@@ -258,23 +400,133 @@ func (f *WasmFunctionRunner) ReadScale() int {
 	return f.replicas
 }
 
-// ScaleFunc scale the replicas
-func (f *WasmFunctionRunner) ScaleFunc(replicas int) error {
+// ScaleMetrics reports slot usage so callers can drive an autoscaling loop.
+type ScaleMetrics struct {
+	Replicas int
+	Free     int
+	InFlight int
+}
+
+// ReadMetrics returns the current free vs in-flight slot counts.
+func (f *WasmFunctionRunner) ReadMetrics() ScaleMetrics {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	free := len(f.freeFuncId)
+	return ScaleMetrics{Replicas: f.replicas, Free: free, InFlight: f.replicas - free}
+}
+
+// ScaleFunc scale the replicas up or down. Scaling down waits for retired
+// slots to finish any in-flight Run before reclaiming them, and fails with an
+// error rather than hanging forever if that doesn't happen within deadline.
+func (f *WasmFunctionRunner) ScaleFunc(replicas int, deadline time.Duration) error {
+	f.mutex.Lock()
 	if replicas == f.replicas {
+		f.mutex.Unlock()
 		return nil
 	}
 	if replicas > f.replicas {
 		if replicas > maxInstanceNum {
+			f.mutex.Unlock()
 			return fmt.Errorf("the replicas cannot greater than maxInstanceNum(%d)", maxInstanceNum)
 		}
 		for i := f.replicas; i < replicas; i++ {
 			f.freeFuncId <- i
 		}
 		f.replicas = replicas
+		f.mutex.Unlock()
+		return nil
+	}
+
+	if replicas < 0 {
+		f.mutex.Unlock()
+		return fmt.Errorf("the replicas cannot be negative")
+	}
+	f.mutex.Unlock()
+
+	// scaleMu, not mutex, guards the drain below: it can block for up to
+	// deadline, and holding mutex for that long would also block
+	// ReadScale/ReadMetrics for the duration.
+	f.scaleMu.Lock()
+	defer f.scaleMu.Unlock()
+
+	// Recompute against the current f.replicas now that scaleMu is held,
+	// not the snapshot taken before it was acquired: a concurrent shrink
+	// may have already retired some or all of these ids (or a concurrent
+	// grow raced ahead), and building retiring off a stale f.replicas would
+	// have this call wait on ids nobody is ever going to free again.
+	f.mutex.Lock()
+	if replicas >= f.replicas {
+		f.mutex.Unlock()
+		return nil
+	}
+	// retiring holds the highest (f.replicas - replicas) ids, the same ones
+	// growth would have added last.
+	retiring := make(map[int]bool, f.replicas-replicas)
+	for i := replicas; i < f.replicas; i++ {
+		retiring[i] = true
+	}
+	f.mutex.Unlock()
+
+	// parked holds free, non-retiring ids popped off freeFuncId while
+	// draining. They're only pushed back once the drain is done rather than
+	// immediately: requeuing them right away keeps freeFuncId permanently
+	// ready, so the select below would keep picking that case over
+	// time.After and busy-spin until the deadline instead of actually
+	// blocking for a retiring id.
+	var parked []int
+	// retired holds ids already removed from the retiring set (work dir
+	// deleted) this call. If we bail out before draining the rest, these
+	// ids must go back into freeFuncId rather than staying lost: f.replicas
+	// is only updated once the whole drain succeeds, so on bail-out it
+	// still counts them as live, and the next ScaleFunc call would recompute
+	// retiring against that same f.replicas and wait forever on ids nothing
+	// will ever return. Run recreates its work dir unconditionally, so
+	// handing a retired id back out is exactly as safe as never retiring it.
+	var retired []int
+	giveBack := func() {
+		for _, id := range parked {
+			f.freeFuncId <- id
+		}
+		for _, id := range retired {
+			f.freeFuncId <- id
+		}
 	}
-	// todo: shrink for replicas
+
+	deadlineAt := time.Now().Add(deadline)
+	for len(retiring) > 0 {
+		remaining := time.Until(deadlineAt)
+		if remaining <= 0 {
+			giveBack()
+			return fmt.Errorf("scale down to %d replicas did not complete within %s", replicas, deadline)
+		}
+
+		select {
+		case id := <-f.freeFuncId:
+			if !retiring[id] {
+				parked = append(parked, id)
+				continue
+			}
+			if err := os.RemoveAll(fmt.Sprintf("%d", id)); err != nil {
+				// leave the dir as-is for Run to clean up on reuse
+				parked = append(parked, id)
+				giveBack()
+				return fmt.Errorf("removing work dir for retired id %d: %w", id, err)
+			}
+			delete(retiring, id)
+			retired = append(retired, id)
+		case <-time.After(remaining):
+			giveBack()
+			return fmt.Errorf("scale down to %d replicas did not complete within %s", replicas, deadline)
+		}
+	}
+
+	for _, id := range parked {
+		f.freeFuncId <- id
+	}
+
+	f.mutex.Lock()
+	f.replicas = replicas
+	f.mutex.Unlock()
 	return nil
 }
 